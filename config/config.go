@@ -0,0 +1,63 @@
+// Package config holds the configuration structures used to bootstrap
+// Inbucket's various servers.
+package config
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// SmtpConfig houses the SMTP server configuration
+type SmtpConfig struct {
+	Ip4address      net.IP
+	Ip4port         int
+	Domain          string
+	DomainNoStore   string
+	MaxRecipients   int
+	MaxIdleSeconds  int
+	MaxMessageBytes int
+	StoreMessages   bool
+
+	// AuthRequired rejects MAIL FROM until the client has completed AUTH.
+	AuthRequired bool
+
+	// RelayHost and RelayPort, when RelayHost is non-empty, configure a
+	// default upstream SMTP server that accepted mail is relayed to
+	// instead of (or in addition to) being stored locally.
+	RelayHost string
+	RelayPort int
+	RelayAuth *RelayAuth
+
+	// ProxyProtocol enables parsing a PROXY protocol header off the front
+	// of each connection, so the real client IP survives behind a
+	// load balancer such as HAProxy or Envoy.
+	ProxyProtocol ProxyProtocolMode
+
+	// TLSConfig, when non-nil, is used to service the STARTTLS command. A
+	// nil value causes the server to omit STARTTLS from its EHLO response.
+	TLSConfig *tls.Config
+}
+
+// RelayAuth holds the PLAIN-auth credentials used when connecting to
+// RelayHost, if the upstream server requires authentication.
+type RelayAuth struct {
+	Username string
+	Password string
+}
+
+// ProxyProtocolMode selects whether and which version of the PROXY
+// protocol a listener expects on newly accepted connections.
+type ProxyProtocolMode int
+
+const (
+	// ProxyProtocolOff disables PROXY protocol parsing; the TCP peer
+	// address is used as-is.
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// ProxyProtocolV1 requires the textual v1 header on every connection.
+	ProxyProtocolV1
+	// ProxyProtocolV2 requires the binary v2 header on every connection.
+	ProxyProtocolV2
+	// ProxyProtocolEither accepts either the v1 or v2 header, detected
+	// from the first bytes of the connection.
+	ProxyProtocolEither
+)
@@ -0,0 +1,186 @@
+package smtpd
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authenticator validates a completed SASL exchange. mechanism is one of
+// "PLAIN", "LOGIN", or "CRAM-MD5".
+//
+// For PLAIN and LOGIN, identity is the (possibly empty) authorization
+// identity and secret is the plaintext password supplied by the client.
+//
+// For CRAM-MD5, identity is the challenge the server issued, username is
+// the claimed user, and secret is the HMAC-MD5 digest the client returned,
+// already hex-decoded. Implementations are expected to hold the user's
+// shared secret, recompute HMAC-MD5(secret, identity) and compare against
+// the provided digest.
+type Authenticator interface {
+	Authenticate(mechanism, identity, username string, secret []byte) error
+}
+
+// auth dispatches the AUTH verb to the requested SASL mechanism.
+func (ses *session) auth(arg string) {
+	if ses.server.Authenticator == nil {
+		ses.send("502 Command not implemented")
+		return
+	}
+	if ses.state != READY {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+
+	mechanism, initial := splitCommand(arg)
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		ses.authPlain(initial)
+	case "LOGIN":
+		ses.authLogin(initial)
+	case "CRAM-MD5":
+		ses.authCramMD5()
+	default:
+		ses.send("504 Unrecognized authentication mechanism")
+	}
+}
+
+// authOutcome reports the result of a completed mechanism to the client and
+// restores the session to READY on success or failure alike; only a
+// dropped connection ends the session.
+func (ses *session) authOutcome(err error) {
+	if err != nil {
+		ses.send("535 Authentication failed")
+		ses.state = READY
+		return
+	}
+	ses.authenticated = true
+	ses.state = READY
+	ses.send("235 Authentication successful")
+}
+
+// readAuthLine prompts with a base64-encoded 334 continuation and reads the
+// client's base64 response. A bare "*" aborts the exchange per RFC 4954.
+func (ses *session) readAuthLine(prompt string) (string, bool) {
+	ses.send("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := ses.readLine()
+	if err != nil {
+		ses.state = QUIT
+		return "", false
+	}
+	if line == "*" {
+		ses.send("501 Authentication cancelled")
+		ses.state = READY
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		ses.send("501 Invalid base64 response")
+		ses.state = READY
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// authPlain implements RFC 4616: a single base64 blob of the form
+// "authzid\x00username\x00password".
+func (ses *session) authPlain(initial string) {
+	ses.state = AUTH
+	blob := initial
+	if blob == "" {
+		decoded, ok := ses.readAuthLine("")
+		if !ok {
+			return
+		}
+		blob = decoded
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(blob)
+		if err != nil {
+			ses.send("501 Invalid base64 response")
+			ses.state = READY
+			return
+		}
+		blob = string(decoded)
+	}
+
+	parts := strings.SplitN(blob, "\x00", 3)
+	if len(parts) != 3 {
+		ses.send("501 Malformed AUTH PLAIN response")
+		ses.state = READY
+		return
+	}
+	identity, username, password := parts[0], parts[1], parts[2]
+	err := ses.server.Authenticator.Authenticate("PLAIN", identity, username, []byte(password))
+	ses.authOutcome(err)
+}
+
+// authLogin implements the two-prompt Microsoft LOGIN mechanism.
+func (ses *session) authLogin(initial string) {
+	ses.state = AUTH
+	username := initial
+	if username == "" {
+		decoded, ok := ses.readAuthLine("Username:")
+		if !ok {
+			return
+		}
+		username = decoded
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(username)
+		if err != nil {
+			ses.send("501 Invalid base64 response")
+			ses.state = READY
+			return
+		}
+		username = string(decoded)
+	}
+
+	password, ok := ses.readAuthLine("Password:")
+	if !ok {
+		return
+	}
+
+	err := ses.server.Authenticator.Authenticate("LOGIN", "", username, []byte(password))
+	ses.authOutcome(err)
+}
+
+// authCramMD5 implements RFC 2195: the server issues a unique challenge and
+// the client replies with "user HMAC-MD5(secret, challenge)" in hex.
+func (ses *session) authCramMD5() {
+	ses.state = AUTH
+	challenge := fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), ses.server.domain)
+
+	response, ok := ses.readAuthLine(challenge)
+	if !ok {
+		return
+	}
+
+	fields := strings.SplitN(response, " ", 2)
+	if len(fields) != 2 {
+		ses.send("501 Malformed AUTH CRAM-MD5 response")
+		ses.state = READY
+		return
+	}
+	username, digestHex := fields[0], fields[1]
+	digest, err := hex.DecodeString(digestHex)
+	if err != nil {
+		ses.send("501 Invalid hex digest")
+		ses.state = READY
+		return
+	}
+
+	err = ses.server.Authenticator.Authenticate("CRAM-MD5", challenge, username, digest)
+	ses.authOutcome(err)
+}
+
+// hmacMD5 is a convenience for Authenticator implementations verifying
+// CRAM-MD5 responses: HMAC-MD5(secret, challenge).
+func hmacMD5(secret []byte, challenge string) []byte {
+	mac := hmac.New(md5.New, secret)
+	mac.Write([]byte(challenge))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,189 @@
+package smtpd
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+// fakeAuthenticator accepts a single hard-coded user/password pair and is
+// used to exercise the AUTH verb without any real credential store.
+type fakeAuthenticator struct {
+	username string
+	password string
+}
+
+func (a *fakeAuthenticator) Authenticate(mechanism, identity, username string, secret []byte) error {
+	if username != a.username {
+		return fmt.Errorf("unknown user %q", username)
+	}
+	if mechanism == "CRAM-MD5" {
+		mac := hmac.New(md5.New, []byte(a.password))
+		mac.Write([]byte(identity))
+		if !hmac.Equal(mac.Sum(nil), secret) {
+			return fmt.Errorf("bad CRAM-MD5 digest")
+		}
+		return nil
+	}
+	if string(secret) != a.password {
+		return fmt.Errorf("bad password")
+	}
+	return nil
+}
+
+// b64 is a short alias to keep the script-style test tables readable.
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestAuthPlain(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+	server.Authenticator = &fakeAuthenticator{username: "john", password: "secret"}
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := c.Cmd("HELO localhost"); err == nil {
+		c.StartResponse(id)
+		c.ReadCodeLine(250)
+		c.EndResponse(id)
+	}
+
+	// Bad credentials are rejected with 535.
+	id, _ := c.Cmd("AUTH PLAIN " + b64("\x00john\x00wrong"))
+	c.StartResponse(id)
+	if _, _, err := c.ReadCodeLine(535); err != nil {
+		t.Errorf("expected 535 for bad AUTH PLAIN credentials: %v", err)
+	}
+	c.EndResponse(id)
+
+	// Good credentials succeed with 235, unlocking MAIL FROM.
+	id, _ = c.Cmd("AUTH PLAIN " + b64("\x00john\x00secret"))
+	c.StartResponse(id)
+	if _, _, err := c.ReadCodeLine(235); err != nil {
+		t.Errorf("expected 235 for good AUTH PLAIN credentials: %v", err)
+	}
+	c.EndResponse(id)
+
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+	server.Authenticator = &fakeAuthenticator{username: "john", password: "secret"}
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	c.ReadCodeLine(220)
+	id, _ := c.Cmd("HELO localhost")
+	c.StartResponse(id)
+	c.ReadCodeLine(250)
+	c.EndResponse(id)
+
+	id, _ = c.Cmd("AUTH LOGIN")
+	c.StartResponse(id)
+	if _, _, err := c.ReadCodeLine(334); err != nil {
+		t.Fatalf("expected 334 Username prompt: %v", err)
+	}
+	c.EndResponse(id)
+
+	id, _ = c.Cmd(b64("john"))
+	c.StartResponse(id)
+	if _, _, err := c.ReadCodeLine(334); err != nil {
+		t.Fatalf("expected 334 Password prompt: %v", err)
+	}
+	c.EndResponse(id)
+
+	id, _ = c.Cmd(b64("secret"))
+	c.StartResponse(id)
+	if _, _, err := c.ReadCodeLine(235); err != nil {
+		t.Errorf("expected 235 for good AUTH LOGIN credentials: %v", err)
+	}
+	c.EndResponse(id)
+
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+func TestAuthCramMD5(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+	server.Authenticator = &fakeAuthenticator{username: "john", password: "secret"}
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	c.ReadCodeLine(220)
+	id, _ := c.Cmd("HELO localhost")
+	c.StartResponse(id)
+	c.ReadCodeLine(250)
+	c.EndResponse(id)
+
+	id, _ = c.Cmd("AUTH CRAM-MD5")
+	c.StartResponse(id)
+	_, msg, err := c.ReadCodeLine(334)
+	c.EndResponse(id)
+	if err != nil {
+		t.Fatalf("expected 334 challenge: %v", err)
+	}
+	challengeBytes, err := base64.StdEncoding.DecodeString(msg)
+	if err != nil {
+		t.Fatalf("challenge was not base64: %v", err)
+	}
+	challenge := string(challengeBytes)
+
+	mac := hmac.New(md5.New, []byte("secret"))
+	mac.Write([]byte(challenge))
+	digest := hex.EncodeToString(mac.Sum(nil))
+
+	id, _ = c.Cmd(b64("john " + digest))
+	c.StartResponse(id)
+	if _, _, err := c.ReadCodeLine(235); err != nil {
+		t.Errorf("expected 235 for good AUTH CRAM-MD5 response: %v", err)
+	}
+	c.EndResponse(id)
+
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+// TestAuthRequired verifies that MAIL FROM is rejected before AUTH when the
+// server is configured to require authentication.
+func TestAuthRequired(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+	server.authRequired = true
+	server.Authenticator = &fakeAuthenticator{username: "john", password: "secret"}
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 530},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
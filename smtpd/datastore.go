@@ -0,0 +1,60 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// DataStore is implemented by anything capable of persisting an inbound
+// message. NewFileDataStore returns the default on-disk implementation.
+type DataStore interface {
+	// StoreMessage persists a single message, returning an identifier the
+	// caller may use to refer back to it.
+	StoreMessage(from string, recipients []string, data []byte) (id string, err error)
+}
+
+// FileDataStore is a DataStore that writes each message to its own file
+// underneath a root directory.
+type FileDataStore struct {
+	path string
+}
+
+// NewFileDataStore creates a FileDataStore rooted at path. The directory is
+// not created here; it is expected to already exist.
+func NewFileDataStore(path string) *FileDataStore {
+	return &FileDataStore{path: path}
+}
+
+// StoreMessage implements DataStore.
+func (ds *FileDataStore) StoreMessage(from string, recipients []string, data []byte) (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "From: %s\n", from)
+	for _, rcpt := range recipients {
+		fmt.Fprintf(&buf, "To: %s\n", rcpt)
+	}
+	buf.WriteString("\n")
+	buf.Write(data)
+
+	if err := ioutil.WriteFile(filepath.Join(ds.path, id+".msg"), []byte(buf.String()), 0660); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// generateID returns a short random hex string suitable for use as a
+// message filename.
+func generateID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
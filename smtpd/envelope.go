@@ -0,0 +1,47 @@
+package smtpd
+
+import "net"
+
+// Envelope describes a single accepted message: who sent it, who it's
+// addressed to, and its raw DATA payload.
+type Envelope struct {
+	RemoteAddr net.Addr
+	From       string
+	Recipients []string
+	Data       []byte
+}
+
+// MessageHandler receives each accepted envelope once DATA completes, in
+// place of (or alongside) storage in a DataStore. It's the extension point
+// for relaying, DKIM-signing, or otherwise forwarding mail upstream.
+type MessageHandler interface {
+	HandleMessage(envelope *Envelope) error
+}
+
+// EnvelopeRewriter is an optional interface a MessageHandler may also
+// implement to mutate the envelope (e.g. add headers, rewrite From) before
+// HandleMessage is called.
+type EnvelopeRewriter interface {
+	Rewrite(envelope *Envelope)
+}
+
+// HandlerError lets a MessageHandler communicate a specific SMTP reply
+// code and message back to the client, for example an upstream RCPT
+// rejection discovered during relay.
+type HandlerError struct {
+	Code    int
+	Message string
+}
+
+func (e *HandlerError) Error() string {
+	return e.Message
+}
+
+// noopHandler accepts and discards every envelope. It backs
+// config.SmtpConfig.DomainNoStore: mail addressed there is acknowledged but
+// never persisted or forwarded.
+type noopHandler struct{}
+
+func (noopHandler) HandleMessage(envelope *Envelope) error {
+	return nil
+}
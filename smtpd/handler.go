@@ -0,0 +1,650 @@
+// Package smtpd implements a small, self-contained SMTP server used by
+// Inbucket to accept inbound mail.
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// State tracks where a session is in the SMTP command sequence.
+type State int
+
+const (
+	GREET State = iota
+	READY
+	AUTH
+	MAIL
+	DATA
+	QUIT
+)
+
+func (s State) String() string {
+	switch s {
+	case GREET:
+		return "GREET"
+	case READY:
+		return "READY"
+	case AUTH:
+		return "AUTH"
+	case MAIL:
+		return "MAIL"
+	case DATA:
+		return "DATA"
+	case QUIT:
+		return "QUIT"
+	}
+	return "Unknown"
+}
+
+// extensions lists the ESMTP extensions always advertised in response to
+// EHLO, in the order they should appear. ehlo adds SIZE ahead of them, and
+// STARTTLS and AUTH after them when those are configured.
+var extensions = []string{
+	"8BITMIME",
+	"PIPELINING",
+}
+
+// Server holds the configuration and shared state for a running SMTP
+// listener. Use NewSmtpServer to construct one.
+type Server struct {
+	domain          string
+	domainNoStore   string
+	maxRecips       int
+	maxIdleSeconds  int
+	maxMessageBytes int
+	storeMessages   bool
+	ip4address      net.IP
+	ip4port         int
+	tlsConfig       *tls.Config
+	authRequired    bool
+	proxyProtocol   config.ProxyProtocolMode
+
+	// Authenticator, when set, enables the AUTH verb. It is not part of
+	// config.SmtpConfig because config cannot import smtpd without a cycle;
+	// callers set it directly after construction.
+	Authenticator Authenticator
+
+	// Handler, when set, receives every envelope that isn't claimed by a
+	// more specific entry in DomainRoutes, alongside normal storage.
+	Handler MessageHandler
+
+	// DomainRoutes maps a recipient domain (lowercased) to the
+	// MessageHandler responsible for it, overriding both Handler and
+	// local storage for that domain's recipients.
+	DomainRoutes map[string]MessageHandler
+
+	// Hooks let callers reject HELO/MAIL/RCPT/DATA with a precise SMTP
+	// reply without forking the server. Any of these may be left nil.
+	HeloChecker      HeloChecker
+	SenderChecker    SenderChecker
+	RecipientChecker RecipientChecker
+	DataChecker      DataChecker
+
+	dataStore DataStore
+	listener  net.Listener
+	shutdown  bool
+	waitgroup sync.WaitGroup
+}
+
+// NewSmtpServer creates a new Server using the given configuration and
+// backing DataStore. The server is not listening until Start is called.
+func NewSmtpServer(cfg config.SmtpConfig, ds DataStore) *Server {
+	s := &Server{
+		domain:          cfg.Domain,
+		domainNoStore:   cfg.DomainNoStore,
+		maxRecips:       cfg.MaxRecipients,
+		maxIdleSeconds:  cfg.MaxIdleSeconds,
+		maxMessageBytes: cfg.MaxMessageBytes,
+		storeMessages:   cfg.StoreMessages,
+		ip4address:      cfg.Ip4address,
+		ip4port:         cfg.Ip4port,
+		tlsConfig:       cfg.TLSConfig,
+		authRequired:    cfg.AuthRequired,
+		proxyProtocol:   cfg.ProxyProtocol,
+		dataStore:       ds,
+		DomainRoutes:    make(map[string]MessageHandler),
+	}
+	if cfg.DomainNoStore != "" {
+		// DomainNoStore is just a route to a handler that accepts and
+		// discards every message addressed there.
+		s.DomainRoutes[strings.ToLower(cfg.DomainNoStore)] = noopHandler{}
+	}
+	if cfg.RelayHost != "" {
+		s.Handler = NewRelayHandler(cfg.RelayHost, cfg.RelayPort, cfg.RelayAuth)
+	}
+	return s
+}
+
+// Start binds the configured address and accepts connections until Stop is
+// called.
+func (s *Server) Start() error {
+	addr := &net.TCPAddr{IP: s.ip4address, Port: s.ip4port}
+	listener, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start SMTP listener: %v", err)
+	}
+	s.listener = listener
+	log.Printf("SMTP listening on %v", addr)
+
+	var sessionNum int
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.shutdown {
+				return nil
+			}
+			return fmt.Errorf("SMTP accept error: %v", err)
+		}
+		s.waitgroup.Add(1)
+		sessionNum++
+		go s.startSession(sessionNum, conn)
+	}
+}
+
+// Stop closes the listener and waits for in-flight sessions to finish.
+func (s *Server) Stop() {
+	s.shutdown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.waitgroup.Wait()
+}
+
+// session represents a single client connection and its SMTP state.
+type session struct {
+	server        *Server
+	id            int
+	conn          net.Conn
+	remoteAddr    net.Addr
+	remoteHost    string
+	reader        *bufio.Reader
+	state         State
+	helloSeen     bool
+	isTLS         bool
+	authenticated bool
+	from          string
+	recipients    []string
+	data          []byte
+}
+
+// startSession drives a single client connection through the SMTP state
+// machine until QUIT or the connection is dropped.
+func (s *Server) startSession(id int, conn net.Conn) {
+	defer s.waitgroup.Done()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	remoteAddr := conn.RemoteAddr()
+
+	if s.proxyProtocol != config.ProxyProtocolOff {
+		parsed, err := readProxyHeader(reader, s.proxyProtocol)
+		if err != nil {
+			// A malformed PROXY header means we can't trust anything that
+			// follows; drop the connection before any SMTP banner is sent.
+			log.Printf("SMTP connection #%v rejected: %v", id, err)
+			return
+		}
+		if parsed != nil {
+			remoteAddr = parsed
+		}
+	}
+
+	remoteHost := "unknown"
+	if addr, ok := remoteAddr.(*net.TCPAddr); ok {
+		remoteHost = addr.IP.String()
+	}
+
+	ses := &session{
+		server:     s,
+		id:         id,
+		conn:       conn,
+		remoteAddr: remoteAddr,
+		remoteHost: remoteHost,
+		reader:     reader,
+		state:      GREET,
+	}
+	log.Printf("SMTP connection #%v from %v", id, remoteHost)
+	ses.greet()
+
+	for ses.state != QUIT {
+		line, err := ses.readLine()
+		if err != nil {
+			log.Printf("SMTP #%v read error: %v", id, err)
+			return
+		}
+		ses.handle(line)
+	}
+}
+
+// greet sends the initial 220 banner.
+func (ses *session) greet() {
+	ses.send(fmt.Sprintf("220 %v SMTP Inbucket ready", ses.server.domain))
+}
+
+// readLine reads a single CRLF-terminated command line from the client.
+func (ses *session) readLine() (string, error) {
+	line, err := ses.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// send writes a single-line response, appending the CRLF terminator.
+func (ses *session) send(msg string) {
+	fmt.Fprintf(ses.conn, "%v\r\n", msg)
+}
+
+// sendMultiline writes a multi-line reply sharing a single status code,
+// e.g. the extensions listed in an EHLO response.
+func (ses *session) sendMultiline(code int, lines ...string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(ses.conn, "%v%v%v\r\n", code, sep, line)
+	}
+}
+
+// handle dispatches a single command line to the appropriate verb handler.
+func (ses *session) handle(line string) {
+	cmd, arg := splitCommand(line)
+	switch strings.ToUpper(cmd) {
+	case "HELO":
+		ses.helo(arg)
+	case "EHLO":
+		ses.ehlo(arg)
+	case "STARTTLS":
+		ses.starttls(arg)
+	case "AUTH":
+		ses.auth(arg)
+	case "MAIL":
+		ses.mail(arg)
+	case "RCPT":
+		ses.rcpt(arg)
+	case "DATA":
+		ses.dataCmd(arg)
+	case "RSET":
+		ses.rset()
+	case "NOOP":
+		ses.send("250 I can do nothing all day")
+	case "QUIT":
+		ses.send("221 Goodnight and good luck")
+		ses.state = QUIT
+	default:
+		ses.send(fmt.Sprintf("500 Unrecognized command: %v", cmd))
+	}
+}
+
+// splitCommand separates the verb from its argument string.
+func splitCommand(line string) (cmd, arg string) {
+	line = strings.TrimSpace(line)
+	parts := strings.SplitN(line, " ", 2)
+	cmd = parts[0]
+	if len(parts) == 2 {
+		arg = strings.TrimSpace(parts[1])
+	}
+	return cmd, arg
+}
+
+// helo handles the plain HELO verb, valid only in the GREET state.
+func (ses *session) helo(arg string) {
+	if ses.state != GREET {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+	if ses.server.HeloChecker != nil {
+		if err := ses.server.HeloChecker(ses.remoteAddr, arg); err != nil {
+			ses.send(replyLine(err))
+			return
+		}
+	}
+	ses.helloSeen = true
+	ses.state = READY
+	ses.send(fmt.Sprintf("250 Hello %v", ses.server.domain))
+}
+
+// ehlo handles EHLO, advertising the server's supported extensions.
+func (ses *session) ehlo(arg string) {
+	if ses.state != GREET {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+	if ses.server.HeloChecker != nil {
+		if err := ses.server.HeloChecker(ses.remoteAddr, arg); err != nil {
+			ses.send(replyLine(err))
+			return
+		}
+	}
+	ses.helloSeen = true
+	ses.state = READY
+
+	lines := []string{fmt.Sprintf("Hello %v", ses.server.domain)}
+	lines = append(lines, fmt.Sprintf("SIZE %v", ses.server.maxMessageBytes))
+	lines = append(lines, extensions...)
+	if ses.server.tlsConfig != nil && !ses.isTLS {
+		lines = append(lines, "STARTTLS")
+	}
+	if ses.server.Authenticator != nil {
+		lines = append(lines, "AUTH PLAIN LOGIN CRAM-MD5")
+	}
+	ses.sendMultiline(250, lines...)
+}
+
+// starttls upgrades the connection to TLS and resets the session back to
+// the GREET state so the client can re-issue EHLO.
+func (ses *session) starttls(arg string) {
+	if ses.server.tlsConfig == nil {
+		ses.send("500 Unrecognized command: STARTTLS")
+		return
+	}
+	if ses.isTLS {
+		ses.send("454 TLS already active")
+		return
+	}
+	if ses.state != READY {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+	ses.send("220 Ready to start TLS")
+
+	tlsConn := tls.Server(ses.conn, ses.server.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("SMTP #%v TLS handshake error: %v", ses.id, err)
+		ses.state = QUIT
+		return
+	}
+	ses.conn = tlsConn
+	ses.reader = bufio.NewReader(tlsConn)
+	ses.helloSeen = false
+	ses.isTLS = true
+	ses.state = GREET
+}
+
+// mail handles MAIL FROM, valid only in the READY state.
+func (ses *session) mail(arg string) {
+	if ses.state != READY {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+	if ses.server.authRequired && !ses.authenticated {
+		ses.send("530 Authentication required")
+		return
+	}
+	from, ok := parseMailFrom(arg)
+	if !ok {
+		ses.send("501 Syntax error in MAIL command")
+		return
+	}
+	if ses.server.SenderChecker != nil {
+		if err := ses.server.SenderChecker(from); err != nil {
+			ses.send(replyLine(err))
+			return
+		}
+	}
+	ses.from = from
+	ses.recipients = nil
+	ses.data = nil
+	ses.state = MAIL
+	ses.send("250 Roger, accepting mail from " + from)
+}
+
+// parseMailFrom parses the argument of a MAIL command, e.g.
+// "FROM:<john@gmail.com> SIZE=1024". The address must be bracketed, and any
+// trailing parameters must be recognized KEY or KEY=VALUE pairs.
+func parseMailFrom(arg string) (string, bool) {
+	const prefix = "from:"
+	if !strings.HasPrefix(strings.ToLower(arg), prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+
+	addr, rest, ok := takeBracketedAddress(rest)
+	if !ok {
+		return "", false
+	}
+
+	for _, param := range splitParams(rest) {
+		key, val, _ := splitParam(param)
+		switch strings.ToUpper(key) {
+		case "SIZE":
+			if val == "" || !isDigits(val) {
+				return "", false
+			}
+		case "BODY":
+			val = strings.ToUpper(val)
+			if val != "8BITMIME" && val != "7BIT" {
+				return "", false
+			}
+		default:
+			return "", false
+		}
+	}
+	return addr, true
+}
+
+// rcpt handles RCPT TO, valid only in the MAIL state.
+func (ses *session) rcpt(arg string) {
+	if ses.state != MAIL {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+	to, ok := parseRcptTo(arg)
+	if !ok {
+		ses.send("501 Syntax error in RCPT command")
+		return
+	}
+	if ses.server.RecipientChecker != nil {
+		if err := ses.server.RecipientChecker(ses.from, to); err != nil {
+			ses.send(replyLine(err))
+			return
+		}
+	}
+	if len(ses.recipients) >= ses.server.maxRecips {
+		ses.send(fmt.Sprintf("552 Too many recipients, max is %v", ses.server.maxRecips))
+		return
+	}
+	ses.recipients = append(ses.recipients, to)
+	ses.send("250 I'll make sure " + to + " gets this")
+}
+
+// parseRcptTo parses the argument of a RCPT command. Unlike MAIL FROM, the
+// address brackets are optional, matching the original Inbucket behavior.
+func parseRcptTo(arg string) (string, bool) {
+	const prefix = "to:"
+	if !strings.HasPrefix(strings.ToLower(arg), prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if rest == "" {
+		return "", false
+	}
+	if strings.HasPrefix(rest, "<") {
+		addr, _, ok := takeBracketedAddress(rest)
+		return addr, ok
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// dataCmd handles DATA, valid only once a MAIL FROM and at least one RCPT
+// TO have been accepted.
+func (ses *session) dataCmd(arg string) {
+	if ses.state != MAIL || len(ses.recipients) == 0 {
+		ses.send("503 Bad sequence of commands")
+		return
+	}
+	ses.send("354 Start mail input; end with <CRLF>.<CRLF>")
+
+	var buf []byte
+	overflowed := false
+	for {
+		line, err := ses.readLine()
+		if err != nil {
+			log.Printf("SMTP #%v read error: %v", ses.id, err)
+			ses.state = QUIT
+			return
+		}
+		if line == "." {
+			break
+		}
+		if overflowed {
+			// Already over the limit; keep draining input up to the
+			// terminator without growing buf further, so the session
+			// stays in sync once we reply.
+			continue
+		}
+		buf = append(buf, []byte(line+"\r\n")...)
+		if len(buf) > ses.server.maxMessageBytes {
+			overflowed = true
+		}
+	}
+	if overflowed {
+		ses.send("552 Message exceeds maximum size")
+		ses.state = READY
+		return
+	}
+	ses.data = buf
+
+	envelope := &Envelope{
+		RemoteAddr: ses.remoteAddr,
+		From:       ses.from,
+		Recipients: ses.recipients,
+		Data:       ses.data,
+	}
+	if ses.server.DataChecker != nil {
+		if err := ses.server.DataChecker(envelope, ses.data); err != nil {
+			ses.send(replyLine(err))
+			ses.state = READY
+			return
+		}
+	}
+	if err := ses.deliver(envelope); err != nil {
+		if _, ok := err.(*HandlerError); !ok {
+			log.Printf("SMTP #%v failed to deliver message: %v", ses.id, err)
+		}
+		ses.send(replyLine(err))
+		ses.state = READY
+		return
+	}
+	ses.send("250 Mail accepted for delivery")
+	ses.state = READY
+}
+
+// deliver routes an accepted envelope to storage and/or a MessageHandler,
+// splitting recipients by domain so DomainRoutes can override handling on a
+// per-domain basis.
+func (ses *session) deliver(envelope *Envelope) error {
+	for domain, recipients := range groupByDomain(envelope.Recipients) {
+		sub := &Envelope{
+			RemoteAddr: envelope.RemoteAddr,
+			From:       envelope.From,
+			Recipients: recipients,
+			Data:       envelope.Data,
+		}
+		if handler, ok := ses.server.DomainRoutes[domain]; ok {
+			if err := rewriteAndHandle(handler, sub); err != nil {
+				return err
+			}
+			continue
+		}
+		if ses.server.storeMessages {
+			if _, err := ses.server.dataStore.StoreMessage(sub.From, sub.Recipients, sub.Data); err != nil {
+				return err
+			}
+		}
+		if ses.server.Handler != nil {
+			if err := rewriteAndHandle(ses.server.Handler, sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteAndHandle gives handler a chance to mutate the envelope before
+// delivering it.
+func rewriteAndHandle(handler MessageHandler, envelope *Envelope) error {
+	if rewriter, ok := handler.(EnvelopeRewriter); ok {
+		rewriter.Rewrite(envelope)
+	}
+	return handler.HandleMessage(envelope)
+}
+
+// groupByDomain partitions recipients by the domain portion of their
+// address, preserving each recipient's original ordering within its group.
+func groupByDomain(recipients []string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, rcpt := range recipients {
+		domain := ""
+		if i := strings.LastIndex(rcpt, "@"); i >= 0 {
+			domain = strings.ToLower(rcpt[i+1:])
+		}
+		groups[domain] = append(groups[domain], rcpt)
+	}
+	return groups
+}
+
+// rset clears any in-progress envelope, returning the session to READY.
+func (ses *session) rset() {
+	ses.from = ""
+	ses.recipients = nil
+	ses.data = nil
+	ses.state = READY
+	ses.send("250 Reset OK")
+}
+
+// takeBracketedAddress parses a leading "<addr>" from s, returning the
+// address, the remainder of the string, and whether parsing succeeded.
+func takeBracketedAddress(s string) (addr, rest string, ok bool) {
+	if !strings.HasPrefix(s, "<") {
+		return "", s, false
+	}
+	end := strings.Index(s, ">")
+	if end < 0 {
+		return "", s, false
+	}
+	return s[1:end], strings.TrimSpace(s[end+1:]), true
+}
+
+// splitParams splits a trailing "KEY=VAL KEY=VAL" parameter string on
+// whitespace.
+func splitParams(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Fields(s)
+}
+
+// splitParam splits a single "KEY=VAL" parameter into its key and value.
+func splitParam(s string) (key, val string, hasVal bool) {
+	if i := strings.Index(s, "="); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// isDigits reports whether s consists entirely of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
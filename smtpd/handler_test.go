@@ -2,14 +2,21 @@ package smtpd
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"github.com/jhillyerd/inbucket/config"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/textproto"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -50,6 +57,140 @@ func TestGreetState(t *testing.T) {
 		t.Error(err)
 	}
 
+	// EHLO should return a multiline 250 advertising our extensions
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Error(err)
+	}
+	id, err := c.Cmd("EHLO mydom.com")
+	if err != nil {
+		t.Error(err)
+	}
+	c.StartResponse(id)
+	_, msg, err := c.ReadResponse(250)
+	c.EndResponse(id)
+	if err != nil {
+		t.Errorf("Expected a 250 response to EHLO, got %v", err)
+	}
+	for _, want := range []string{"SIZE 5000", "8BITMIME", "PIPELINING"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected EHLO response to contain %q, got %q", want, msg)
+		}
+	}
+	if strings.Contains(msg, "AUTH") {
+		t.Errorf("Expected EHLO response not to advertise AUTH without an Authenticator, got %q", msg)
+	}
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestGreetStateAdvertisesAuth confirms EHLO only advertises AUTH once an
+// Authenticator has been configured.
+func TestGreetStateAdvertisesAuth(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+	server.Authenticator = &fakeAuthenticator{}
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.Cmd("EHLO mydom.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StartResponse(id)
+	_, msg, err := c.ReadResponse(250)
+	c.EndResponse(id)
+	if err != nil {
+		t.Fatalf("Expected a 250 response to EHLO, got %v", err)
+	}
+	if !strings.Contains(msg, "AUTH PLAIN LOGIN CRAM-MD5") {
+		t.Errorf("Expected EHLO response to advertise AUTH with an Authenticator configured, got %q", msg)
+	}
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test STARTTLS negotiation: greeting, EHLO advertises STARTTLS, the
+// handshake succeeds, and the session resets back to GREET afterwards.
+func TestStartTLSState(t *testing.T) {
+	server, logbuf := setupSmtpServerTLS(t)
+	defer teardownSmtpServer(server)
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := c.Cmd("EHLO mydom.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StartResponse(id)
+	_, msg, err := c.ReadResponse(250)
+	c.EndResponse(id)
+	if err != nil {
+		t.Fatalf("Expected a 250 response to EHLO, got %v", err)
+	}
+	if !strings.Contains(msg, "STARTTLS") {
+		t.Errorf("Expected EHLO response to advertise STARTTLS, got %q", msg)
+	}
+
+	if err := c.PrintfLine("STARTTLS"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 response to STARTTLS, got %v", err)
+	}
+
+	tlsConn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	tc := textproto.NewConn(tlsConn)
+
+	id, err = tc.Cmd("EHLO mydom.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.StartResponse(id)
+	_, msg, err = tc.ReadResponse(250)
+	tc.EndResponse(id)
+	if err != nil {
+		t.Fatalf("Expected a 250 response to post-STARTTLS EHLO, got %v", err)
+	}
+	if strings.Contains(msg, "STARTTLS") {
+		t.Errorf("Expected post-STARTTLS EHLO to stop advertising STARTTLS, got %q", msg)
+	}
+
+	// A second STARTTLS on an already-TLS session must be rejected rather
+	// than re-wrapped.
+	id, err = tc.Cmd("STARTTLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.StartResponse(id)
+	if _, _, err := tc.ReadCodeLine(454); err != nil {
+		t.Errorf("Expected 454 for a repeated STARTTLS, got %v", err)
+	}
+	tc.EndResponse(id)
+
+	tc.Cmd("QUIT")
+	tc.ReadCodeLine(221)
+
 	if t.Failed() {
 		// Dump buffered log data if there was a failure
 		io.Copy(os.Stderr, logbuf)
@@ -173,6 +314,41 @@ func TestMailState(t *testing.T) {
 		t.Error(err)
 	}
 
+	// An oversize DATA block must still be fully drained up to the "."
+	// terminator before the 552 is sent, so the session stays in sync.
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatal(err)
+	}
+	c.PrintfLine("HELO localhost")
+	if _, _, err := c.ReadCodeLine(250); err != nil {
+		t.Fatal(err)
+	}
+	c.PrintfLine("MAIL FROM:<john@gmail.com>")
+	if _, _, err := c.ReadCodeLine(250); err != nil {
+		t.Fatal(err)
+	}
+	c.PrintfLine("RCPT TO:<u1@gmail.com>")
+	if _, _, err := c.ReadCodeLine(250); err != nil {
+		t.Fatal(err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadCodeLine(354); err != nil {
+		t.Fatal(err)
+	}
+	c.PrintfLine(strings.Repeat("A", server.maxMessageBytes+1000))
+	c.PrintfLine(".")
+	if _, _, err := c.ReadCodeLine(552); err != nil {
+		t.Fatalf("expected 552 for oversize message, got %v", err)
+	}
+	c.PrintfLine("NOOP")
+	if _, _, err := c.ReadCodeLine(250); err != nil {
+		t.Errorf("expected NOOP to still get a normal 250 after the overflow, session desynced: %v", err)
+	}
+	c.PrintfLine("QUIT")
+	c.ReadCodeLine(221)
+
 	// Test QUIT
 	script = []scriptStep{
 		{"HELO localhost", 250},
@@ -268,6 +444,86 @@ func setupSmtpServer() (*Server, *bytes.Buffer) {
 	return NewSmtpServer(cfg, ds), buf
 }
 
+// setupSmtpServerTLS is setupSmtpServer plus a self-signed TLS config, for
+// exercising STARTTLS.
+func setupSmtpServerTLS(t *testing.T) (*Server, *bytes.Buffer) {
+	path, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		panic(err)
+	}
+	ds := NewFileDataStore(path)
+
+	cfg := config.SmtpConfig{
+		Ip4address:      net.IPv4(127, 0, 0, 1),
+		Ip4port:         2500,
+		Domain:          "inbucket.local",
+		DomainNoStore:   "bitbucket.local",
+		MaxRecipients:   5,
+		MaxIdleSeconds:  5,
+		MaxMessageBytes: 5000,
+		StoreMessages:   true,
+		TLSConfig:       generateTestTLSConfig(t),
+	}
+
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+
+	return NewSmtpServer(cfg, ds), buf
+}
+
+// setupSmtpServerProxy is setupSmtpServer with PROXY protocol parsing
+// enabled, for exercising real-client-IP preservation.
+func setupSmtpServerProxy(mode config.ProxyProtocolMode) (*Server, *bytes.Buffer) {
+	path, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		panic(err)
+	}
+	ds := NewFileDataStore(path)
+
+	cfg := config.SmtpConfig{
+		Ip4address:      net.IPv4(127, 0, 0, 1),
+		Ip4port:         2500,
+		Domain:          "inbucket.local",
+		DomainNoStore:   "bitbucket.local",
+		MaxRecipients:   5,
+		MaxIdleSeconds:  5,
+		MaxMessageBytes: 5000,
+		StoreMessages:   true,
+		ProxyProtocol:   mode,
+	}
+
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+
+	return NewSmtpServer(cfg, ds), buf
+}
+
+// generateTestTLSConfig builds an in-memory self-signed certificate so
+// tests don't depend on files on disk.
+func generateTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "inbucket.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
 var sessionNum int
 
 func setupSmtpSession(server *Server) net.Conn {
@@ -0,0 +1,51 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+)
+
+// SMTPError is an error that knows exactly how it should be reported to
+// the client: a reply code, an optional RFC 3463 enhanced status code, and
+// a human-readable message. Hooks return one of these to control the wire
+// response precisely (e.g. "550 5.7.1 relay not permitted"); a plain error
+// instead falls back to a generic 451.
+type SMTPError struct {
+	Code         int
+	EnhancedCode [3]int
+	Message      string
+}
+
+func (e *SMTPError) Error() string {
+	return e.Message
+}
+
+// replyLine renders err as the line that should be sent to the client in
+// place of a normal success response.
+func replyLine(err error) string {
+	switch e := err.(type) {
+	case *SMTPError:
+		if e.EnhancedCode != ([3]int{}) {
+			return fmt.Sprintf("%v %v.%v.%v %v", e.Code, e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2], e.Message)
+		}
+		return fmt.Sprintf("%v %v", e.Code, e.Message)
+	case *HandlerError:
+		return fmt.Sprintf("%v %v", e.Code, e.Message)
+	default:
+		return "451 Requested action aborted: local error in processing"
+	}
+}
+
+// HeloChecker, when set, is consulted on every HELO/EHLO and may reject the
+// greeting before the session reaches READY.
+type HeloChecker func(remoteAddr net.Addr, heloName string) error
+
+// SenderChecker, when set, is consulted on every MAIL FROM.
+type SenderChecker func(from string) error
+
+// RecipientChecker, when set, is consulted on every RCPT TO.
+type RecipientChecker func(from, to string) error
+
+// DataChecker, when set, is consulted once a message's DATA has been fully
+// read, before it's handed to storage or a MessageHandler.
+type DataChecker func(envelope *Envelope, body []byte) error
@@ -0,0 +1,114 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+// Test that SenderChecker and RecipientChecker can reject specific
+// addresses with a precise, caller-chosen SMTP reply.
+func TestMailHooks(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+
+	server.SenderChecker = func(from string) error {
+		if from == "spammer@example.com" {
+			return &SMTPError{Code: 550, EnhancedCode: [3]int{5, 7, 1}, Message: "sender blacklisted"}
+		}
+		return nil
+	}
+	server.RecipientChecker = func(from, to string) error {
+		if to == "nobody@gmail.com" {
+			return &SMTPError{Code: 550, EnhancedCode: [3]int{5, 1, 1}, Message: "unknown recipient"}
+		}
+		return nil
+	}
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<spammer@example.com>", 550},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	script = []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<nobody@gmail.com>", 550},
+		{"RCPT TO:<u1@gmail.com>", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+// Test that HeloChecker can reject a greeting, and that the exact
+// code/message supplied by the hook reaches the client unchanged.
+func TestHeloHook(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+
+	server.HeloChecker = func(remoteAddr net.Addr, heloName string) error {
+		if heloName == "spammer.example.com" {
+			return &SMTPError{Code: 550, Message: "go away"}
+		}
+		return nil
+	}
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := c.Cmd("HELO spammer.example.com")
+	c.StartResponse(id)
+	_, msg, err := c.ReadCodeLine(550)
+	c.EndResponse(id)
+	if err != nil {
+		t.Fatalf("expected 550 from HeloChecker, got %v: %v", msg, err)
+	}
+	if msg != "go away" {
+		t.Errorf("expected hook message %q, got %q", "go away", msg)
+	}
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+// TestDataHookRejectsSuspiciousBody exercises DataChecker, confirming that
+// a plain error it returns once the body has been read reaches the client
+// as the generic 451 reply.
+func TestDataHookRejectsSuspiciousBody(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+
+	server.DataChecker = func(envelope *Envelope, body []byte) error {
+		if len(body) == 0 {
+			return fmt.Errorf("empty message body")
+		}
+		return nil
+	}
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 451},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
@@ -0,0 +1,141 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// proxyV2Signature is the fixed 12-byte magic that opens every PROXY
+// protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader consumes a PROXY protocol header from r, returning the
+// real client address it describes. A nil address with a nil error means
+// the header was well-formed but carried no address (a v2 LOCAL
+// connection or a v1 "PROXY UNKNOWN" line, e.g. a health check) and the
+// original TCP peer should be used instead.
+func readProxyHeader(r *bufio.Reader, mode config.ProxyProtocolMode) (net.Addr, error) {
+	peeked, err := r.Peek(len(proxyV2Signature))
+	isV2 := err == nil && string(peeked) == string(proxyV2Signature)
+
+	switch mode {
+	case config.ProxyProtocolV1:
+		if isV2 {
+			return nil, fmt.Errorf("proxy protocol: got v2 header, expected v1")
+		}
+		return readProxyV1(r)
+	case config.ProxyProtocolV2:
+		if !isV2 {
+			return nil, fmt.Errorf("proxy protocol: expected v2 header")
+		}
+		return readProxyV2(r)
+	case config.ProxyProtocolEither:
+		if isV2 {
+			return readProxyV2(r)
+		}
+		return readProxyV1(r)
+	default:
+		return nil, nil
+	}
+}
+
+// readProxyV1 parses the single-line ASCII header:
+// "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	fields := strings.Fields(line)
+	if len(fields) == 2 && fields[0] == "PROXY" && fields[1] == "UNKNOWN" {
+		// "PROXY UNKNOWN" is used for non-TCP4/6 connections and health
+		// checks; fall back to the real TCP peer address.
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("proxy protocol: malformed v1 header %q", line)
+	}
+	switch fields[1] {
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported protocol %q", fields[1])
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("proxy protocol: invalid source address %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary v2 header: the 12-byte signature, a 4-byte
+// fixed header, and a variable-length address block.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	if _, err := r.Discard(len(proxyV2Signature)); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %v", err)
+	}
+	fixed := make([]byte, 4)
+	if _, err := readFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %v", err)
+	}
+	version := fixed[0] >> 4
+	command := fixed[0] & 0x0f
+	family := fixed[1] >> 4
+	addrLen := int(binary.BigEndian.Uint16(fixed[2:4]))
+
+	if version != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %v", version)
+	}
+
+	body := make([]byte, addrLen)
+	if _, err := readFull(r, body); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %v", err)
+	}
+
+	// LOCAL connections (e.g. health checks) carry no meaningful address.
+	if command == 0x0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if addrLen < 12 {
+			return nil, fmt.Errorf("proxy protocol: short IPv4 address block")
+		}
+		ip := net.IP(body[0:4])
+		port := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 0x2: // AF_INET6
+		if addrLen < 36 {
+			return nil, fmt.Errorf("proxy protocol: short IPv6 address block")
+		}
+		ip := net.IP(body[0:16])
+		port := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported address family %v", family)
+	}
+}
+
+// readFull reads exactly len(buf) bytes from r.
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
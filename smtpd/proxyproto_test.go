@@ -0,0 +1,158 @@
+package smtpd
+
+import (
+	"encoding/binary"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// captureRemoteAddr wires a HeloChecker that records the remoteAddr it was
+// called with, so tests can confirm the PROXY-parsed address replaced the
+// raw TCP peer.
+func captureRemoteAddr(server *Server) *string {
+	var mu sync.Mutex
+	var seen string
+	server.HeloChecker = func(remoteAddr net.Addr, heloName string) error {
+		mu.Lock()
+		seen = remoteAddr.String()
+		mu.Unlock()
+		return nil
+	}
+	return &seen
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	server, logbuf := setupSmtpServerProxy(config.ProxyProtocolV1)
+	defer teardownSmtpServer(server)
+	seen := captureRemoteAddr(server)
+
+	pipe := setupSmtpSession(server)
+	if _, err := pipe.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 35000 25\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("expected a 220 greeting after the v1 header, got %v", err)
+	}
+	id, _ := c.Cmd("HELO localhost")
+	c.StartResponse(id)
+	c.ReadCodeLine(250)
+	c.EndResponse(id)
+
+	if *seen != "203.0.113.7:35000" {
+		t.Errorf("expected remote addr 203.0.113.7:35000, got %v", *seen)
+	}
+
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+// TestProxyProtocolV1Unknown verifies that the "PROXY UNKNOWN" form (used by
+// HAProxy/Envoy for health checks and non-TCP4/6 connections) falls back to
+// the real TCP peer address instead of dropping the connection.
+func TestProxyProtocolV1Unknown(t *testing.T) {
+	server, logbuf := setupSmtpServerProxy(config.ProxyProtocolV1)
+	defer teardownSmtpServer(server)
+	seen := captureRemoteAddr(server)
+
+	pipe := setupSmtpSession(server)
+	if _, err := pipe.Write([]byte("PROXY UNKNOWN\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("expected a 220 greeting after the PROXY UNKNOWN header, got %v", err)
+	}
+	id, _ := c.Cmd("HELO localhost")
+	c.StartResponse(id)
+	c.ReadCodeLine(250)
+	c.EndResponse(id)
+
+	if *seen == "" {
+		t.Error("expected the real TCP peer address to be used, got empty remote addr")
+	}
+
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+// encodeProxyV2 builds a binary PROXY v2 header for an IPv4 TCP connection
+// from srcIP:srcPort to dstIP:dstPort.
+func encodeProxyV2(srcIP, dstIP net.IP, srcPort, dstPort uint16) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, srcIP.To4()...)
+	header = append(header, dstIP.To4()...)
+	portBuf := make([]byte, 4)
+	binary.BigEndian.PutUint16(portBuf[0:2], srcPort)
+	binary.BigEndian.PutUint16(portBuf[2:4], dstPort)
+	header = append(header, portBuf...)
+	return header
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	server, logbuf := setupSmtpServerProxy(config.ProxyProtocolV2)
+	defer teardownSmtpServer(server)
+	seen := captureRemoteAddr(server)
+
+	pipe := setupSmtpSession(server)
+	header := encodeProxyV2(net.IPv4(203, 0, 113, 7), net.IPv4(198, 51, 100, 1), 35000, 25)
+	if _, err := pipe.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("expected a 220 greeting after the v2 header, got %v", err)
+	}
+	id, _ := c.Cmd("HELO localhost")
+	c.StartResponse(id)
+	c.ReadCodeLine(250)
+	c.EndResponse(id)
+
+	if *seen != "203.0.113.7:35000" {
+		t.Errorf("expected remote addr 203.0.113.7:35000, got %v", *seen)
+	}
+
+	c.Cmd("QUIT")
+	c.ReadCodeLine(221)
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
+
+// TestProxyProtocolMalformedDropsConnection verifies that a bad header
+// never reaches the point of emitting an SMTP banner.
+func TestProxyProtocolMalformedDropsConnection(t *testing.T) {
+	server, logbuf := setupSmtpServerProxy(config.ProxyProtocolEither)
+	defer teardownSmtpServer(server)
+
+	pipe := setupSmtpSession(server)
+	if _, err := pipe.Write([]byte("GARBAGE not a proxy header\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err == nil {
+		t.Error("expected no SMTP banner after a malformed PROXY header")
+	}
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}
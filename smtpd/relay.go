@@ -0,0 +1,86 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// RelayHandler is a MessageHandler that re-submits each envelope to an
+// upstream SMTP server, turning Inbucket into a forwarding/relay proxy
+// (e.g. in front of a DKIM-signing step) rather than a terminal inbox.
+type RelayHandler struct {
+	host string
+	addr string
+	auth smtp.Auth
+
+	// dial defaults to net.Dial against addr; tests substitute it with an
+	// in-memory net.Pipe to a fake upstream.
+	dial func() (net.Conn, error)
+}
+
+// NewRelayHandler builds a RelayHandler targeting host:port, authenticating
+// with PLAIN auth if auth is non-nil.
+func NewRelayHandler(host string, port int, auth *config.RelayAuth) *RelayHandler {
+	var a smtp.Auth
+	if auth != nil {
+		a = smtp.PlainAuth("", auth.Username, auth.Password, host)
+	}
+	addr := fmt.Sprintf("%v:%v", host, port)
+	r := &RelayHandler{host: host, addr: addr, auth: a}
+	r.dial = func() (net.Conn, error) { return net.Dial("tcp", addr) }
+	return r
+}
+
+// HandleMessage implements MessageHandler by relaying the envelope
+// upstream via net/smtp. Rejections from the upstream server (e.g. an
+// unknown recipient) surface as a *HandlerError carrying its reply code.
+func (r *RelayHandler) HandleMessage(envelope *Envelope) error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, r.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if r.auth != nil {
+		if err := client.Auth(r.auth); err != nil {
+			return relayError(err)
+		}
+	}
+	if err := client.Mail(envelope.From); err != nil {
+		return relayError(err)
+	}
+	for _, rcpt := range envelope.Recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			return relayError(err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return relayError(err)
+	}
+	if _, err := w.Write(envelope.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return relayError(err)
+	}
+	return client.Quit()
+}
+
+// relayError maps an upstream protocol rejection to a HandlerError so the
+// original reply code reaches our client.
+func relayError(err error) error {
+	if protoErr, ok := err.(*textproto.Error); ok {
+		return &HandlerError{Code: protoErr.Code, Message: protoErr.Msg}
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// capturedEnvelope records what a fakeUpstream actually received, so tests
+// can assert the envelope was forwarded faithfully.
+type capturedEnvelope struct {
+	mu    sync.Mutex
+	from  string
+	rcpts []string
+	data  []byte
+}
+
+// fakeUpstream speaks just enough SMTP over an in-memory net.Pipe to stand
+// in for a real relay target. rejectRcpt, if non-empty, causes that single
+// recipient to be rejected with a 550.
+func fakeUpstream(t *testing.T, rejectRcpt string, got *capturedEnvelope) net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		tc := textproto.NewConn(server)
+		defer server.Close()
+		tc.PrintfLine("220 fake.upstream ESMTP")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			upper := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(upper, "EHLO"), strings.HasPrefix(upper, "HELO"):
+				tc.PrintfLine("250 fake.upstream")
+			case strings.HasPrefix(upper, "MAIL FROM:"):
+				got.mu.Lock()
+				got.from = line[len("MAIL FROM:"):]
+				got.mu.Unlock()
+				tc.PrintfLine("250 OK")
+			case strings.HasPrefix(upper, "RCPT TO:"):
+				rcpt := line[len("RCPT TO:"):]
+				if rejectRcpt != "" && strings.Contains(rcpt, rejectRcpt) {
+					tc.PrintfLine("550 5.1.1 no such user")
+					continue
+				}
+				got.mu.Lock()
+				got.rcpts = append(got.rcpts, rcpt)
+				got.mu.Unlock()
+				tc.PrintfLine("250 OK")
+			case upper == "DATA":
+				tc.PrintfLine("354 go ahead")
+				data, err := ioutil.ReadAll(tc.DotReader())
+				if err != nil {
+					t.Errorf("fake upstream failed reading DATA: %v", err)
+				}
+				got.mu.Lock()
+				got.data = data
+				got.mu.Unlock()
+				tc.PrintfLine("250 message accepted")
+			case upper == "QUIT":
+				tc.PrintfLine("221 bye")
+				return
+			default:
+				tc.PrintfLine("500 unknown command")
+			}
+		}
+	}()
+	return client
+}
+
+func TestRelayHandlerForwardsEnvelope(t *testing.T) {
+	got := &capturedEnvelope{}
+	relay := NewRelayHandler("fake.upstream", 25, nil)
+	relay.dial = func() (net.Conn, error) { return fakeUpstream(t, "", got), nil }
+
+	envelope := &Envelope{
+		From:       "john@gmail.com",
+		Recipients: []string{"u1@gmail.com", "u2@gmail.com"},
+		Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+	}
+	if err := relay.HandleMessage(envelope); err != nil {
+		t.Fatalf("HandleMessage: %v", err)
+	}
+
+	got.mu.Lock()
+	defer got.mu.Unlock()
+	if got.from != "<"+envelope.From+">" {
+		t.Errorf("upstream saw From %q, want %q", got.from, "<"+envelope.From+">")
+	}
+	if len(got.rcpts) != 2 ||
+		got.rcpts[0] != "<"+envelope.Recipients[0]+">" ||
+		got.rcpts[1] != "<"+envelope.Recipients[1]+">" {
+		t.Errorf("upstream saw recipients %v, want %v", got.rcpts, envelope.Recipients)
+	}
+	// DATA passes through textproto's dot-reader/writer, which normalizes
+	// CRLF line endings to LF on the receiving end.
+	wantData := strings.ReplaceAll(string(envelope.Data), "\r\n", "\n")
+	if string(got.data) != wantData {
+		t.Errorf("upstream saw data %q, want %q", got.data, wantData)
+	}
+}
+
+func TestRelayHandlerMapsRcptRejection(t *testing.T) {
+	got := &capturedEnvelope{}
+	relay := NewRelayHandler("fake.upstream", 25, nil)
+	relay.dial = func() (net.Conn, error) { return fakeUpstream(t, "u1@gmail.com", got), nil }
+
+	envelope := &Envelope{
+		From:       "john@gmail.com",
+		Recipients: []string{"u1@gmail.com"},
+		Data:       []byte("hello\r\n"),
+	}
+	err := relay.HandleMessage(envelope)
+	if err == nil {
+		t.Fatal("expected an error from the rejected recipient")
+	}
+	herr, ok := err.(*HandlerError)
+	if !ok {
+		t.Fatalf("expected a *HandlerError, got %T: %v", err, err)
+	}
+	if herr.Code != 550 {
+		t.Errorf("expected code 550, got %v", herr.Code)
+	}
+}
+
+// TestDomainNoStoreIsANoopRoute verifies that DomainNoStore recipients are
+// accepted but never reach the DataStore.
+func TestDomainNoStoreIsANoopRoute(t *testing.T) {
+	server, logbuf := setupSmtpServer()
+	defer teardownSmtpServer(server)
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@bitbucket.local>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	ds := server.dataStore.(*FileDataStore)
+	files, err := ioutil.ReadDir(ds.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected DomainNoStore recipient to be skipped, found %d stored message(s)", len(files))
+	}
+
+	if t.Failed() {
+		t.Log(logbuf.String())
+	}
+}